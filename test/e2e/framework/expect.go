@@ -21,19 +21,34 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 
 	tenancyv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/tenancy/v1alpha1"
 	kcpclientset "github.com/kcp-dev/kcp/pkg/client/clientset/versioned"
-	kcpexternalversions "github.com/kcp-dev/kcp/pkg/client/informers/externalversions"
 )
 
+// defaultCacheSyncTimeout bounds how long NewExpecter will wait for the
+// informer's cache to sync if the caller doesn't set ExpecterOptions.CacheSyncTimeout.
+const defaultCacheSyncTimeout = 30 * time.Second
+
+// triggerKey is enqueued for expectations registered with no keys (i.e. ones
+// that care about every object the informer observes, not just one), since
+// the workqueue needs some key to dedupe and requeue against.
+const triggerKey = "trigger"
+
+// maxRecentEvaluations bounds how many evaluationRecords are retained per
+// ExpectBefore/ExpectWithin call for the t.Cleanup failure dump.
+const maxRecentEvaluations = 10
+
 // Expectation closes over a statement of intent, allowing the caller
 // to accumulate errors and determine when the expectation should cease
 // to be evaluated.
@@ -41,107 +56,336 @@ type Expectation func(ctx context.Context) (done bool, err error)
 
 // Expecter allows callers to register expectations
 type Expecter interface {
-	// ExpectBefore will result in the Expectation being evaluated whenever
-	// state changes, up until the desired timeout is reached.
-	ExpectBefore(context.Context, Expectation, time.Duration)
+	// ExpectBefore will result in the Expectation being evaluated whenever one
+	// of the named keys (as produced by cache.MetaNamespaceKeyFunc) changes, up
+	// until the desired timeout is reached. If no keys are given, the
+	// Expectation is evaluated on every object the informer observes - use this
+	// sparingly, as it reintroduces the O(events) cost per expectation that
+	// keying is meant to avoid.
+	ExpectBefore(ctx context.Context, expectation Expectation, timeout time.Duration, keys ...string) error
+
+	// ExpectWithin is like ExpectBefore, but honors the deadline already set on
+	// ctx instead of deriving a new one from a duration.
+	ExpectWithin(ctx context.Context, expectation Expectation, keys ...string) error
+}
+
+// ExpecterOptions configures the behavior of an Expecter returned by NewExpecter.
+type ExpecterOptions struct {
+	// CacheSyncTimeout bounds how long NewExpecter waits for the informer's cache
+	// to sync before giving up. Defaults to defaultCacheSyncTimeout if zero.
+	CacheSyncTimeout time.Duration
+
+	// MaxConcurrentReconciles bounds how many goroutines may evaluate a single
+	// expectation's producer concurrently. Since the underlying workqueue never
+	// hands out the same key twice concurrently, this only buys real
+	// parallelism for an expectation registered against multiple keys (see
+	// ExpectBefore/ExpectWithin); it's a no-op for a single-key expectation.
+	// Defaults to 1.
+	MaxConcurrentReconciles int
+
+	// Registerer, if set, is used to register per-test queue depth,
+	// evaluation count, error count and latency metrics. Metrics are disabled
+	// if left nil.
+	Registerer prometheus.Registerer
 }
 
 // NewExpecter creates a informer-driven registry of expectations, which will
-// be triggered on every event that the informer ingests.
-func NewExpecter(informer cache.SharedIndexInformer) *expectationController {
+// be triggered on the informer events for the keys each expectation was
+// registered against (or on every event, for one registered with no keys).
+// It blocks until the
+// informer's cache has synced, bounded by opts.CacheSyncTimeout, independent of
+// any timeout or deadline a caller later passes to ExpectBefore/ExpectWithin.
+func NewExpecter(ctx context.Context, t TestingTInterface, informer cache.SharedIndexInformer, opts ExpecterOptions) (*expectationController, error) {
+	cacheSyncTimeout := opts.CacheSyncTimeout
+	if cacheSyncTimeout == 0 {
+		cacheSyncTimeout = defaultCacheSyncTimeout
+	}
+	syncCtx, cancel := context.WithTimeout(ctx, cacheSyncTimeout)
+	defer cancel()
+	if !cache.WaitForNamedCacheSync(t.Name(), syncCtx.Done(), informer.HasSynced) {
+		return nil, fmt.Errorf("failed to sync %s cache within %s", t.Name(), cacheSyncTimeout)
+	}
+
+	maxConcurrentReconciles := opts.MaxConcurrentReconciles
+	if maxConcurrentReconciles < 1 {
+		maxConcurrentReconciles = 1
+	}
+
 	controller := expectationController{
-		informer:     informer,
-		expectations: map[uuid.UUID]func(){},
-		lock:         sync.RWMutex{},
+		informer:                informer,
+		expectations:            map[uuid.UUID]*registration{},
+		lock:                    sync.RWMutex{},
+		maxConcurrentReconciles: maxConcurrentReconciles,
+		metrics:                 newExpecterMetrics(opts.Registerer),
+		logger:                  logr.Discard(),
+		t:                       t,
 	}
 
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(_ interface{}) {
-			controller.triggerExpectations()
+		AddFunc: func(obj interface{}) {
+			controller.enqueue(obj)
 		},
-		UpdateFunc: func(_, _ interface{}) {
-			controller.triggerExpectations()
+		UpdateFunc: func(_, obj interface{}) {
+			controller.enqueue(obj)
 		},
-		DeleteFunc: func(_ interface{}) {
-			controller.triggerExpectations()
+		DeleteFunc: func(obj interface{}) {
+			controller.enqueue(obj)
 		},
 	})
 
-	return &controller
+	return &controller, nil
 }
 
 // expectationController triggers the registered expectations on informer events
 type expectationController struct {
 	informer cache.SharedIndexInformer
 	// expectations are recorded by UUID so they may be removed after they complete
-	expectations map[uuid.UUID]func()
-	lock         sync.RWMutex
+	expectations            map[uuid.UUID]*registration
+	lock                    sync.RWMutex
+	maxConcurrentReconciles int
+	metrics                 *expecterMetrics
+
+	// logger receives structured, per-evaluation log lines. Set via WithLogger;
+	// defaults to a no-op logger.
+	logger logr.Logger
+	// t is used to register a t.Cleanup hook per ExpectBefore/ExpectWithin call
+	// that dumps recent evaluation records if the call ultimately failed.
+	t TestingTInterface
+}
+
+// WithLogger sets the logr.Logger used to record structured per-evaluation
+// log lines (expectation UUID, elapsed time, done/err result, running count
+// of evaluations processed so far) and returns c for chaining.
+func (c *expectationController) WithLogger(logger logr.Logger) *expectationController {
+	c.logger = logger
+	return c
+}
+
+// evaluationRecord captures the outcome of a single expectation evaluation.
+type evaluationRecord struct {
+	time    time.Time
+	elapsed time.Duration
+	done    bool
+	err     error
+}
+
+// evaluationLog retains the last maxRecentEvaluations evaluationRecords for a
+// single ExpectBefore/ExpectWithin call.
+type evaluationLog struct {
+	lock    sync.Mutex
+	records []evaluationRecord
+}
+
+func (l *evaluationLog) record(r evaluationRecord) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.records = append(l.records, r)
+	if len(l.records) > maxRecentEvaluations {
+		l.records = l.records[len(l.records)-maxRecentEvaluations:]
+	}
+}
+
+func (l *evaluationLog) dump() []evaluationRecord {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	out := make([]evaluationRecord, len(l.records))
+	copy(out, l.records)
+	return out
+}
+
+// registration holds the per-expectation workqueue that decouples informer
+// events from evaluation: an event enqueues the changed object's key instead
+// of directly invoking the expectation, so repeated events for the same
+// object that arrive while an evaluation is still running collapse into a
+// single pending requeue instead of piling up O(events) work. keys restricts
+// which object keys this expectation cares about; an empty set means "any
+// key" (e.g. an expectation counting across many objects, like
+// ExpectShardLeases).
+type registration struct {
+	queue workqueue.RateLimitingInterface
+	keys  map[string]struct{}
+}
+
+// wants reports whether an event for key should be delivered to this
+// registration.
+func (r *registration) wants(key string) bool {
+	if len(r.keys) == 0 {
+		return true
+	}
+	_, ok := r.keys[key]
+	return ok
 }
 
-func (c *expectationController) triggerExpectations() {
+// enqueue adds obj's key to the queue of every registration that wants it.
+func (c *expectationController) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
-	for _, expectation := range c.expectations {
-		expectation()
+	for _, reg := range c.expectations {
+		if reg.wants(key) {
+			if len(reg.keys) == 0 {
+				reg.queue.Add(triggerKey)
+			} else {
+				reg.queue.Add(key)
+			}
+		}
 	}
 }
 
-func (c *expectationController) ExpectBefore(ctx context.Context, expectation Expectation, duration time.Duration) error {
-	ctx, cancel := context.WithTimeout(ctx, duration)
+func (c *expectationController) ExpectBefore(ctx context.Context, expectation Expectation, timeout time.Duration, keys ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	type result struct {
-		done bool
-		err  error
+	return c.expectWithin(ctx, expectation, keys...)
+}
+
+func (c *expectationController) ExpectWithin(ctx context.Context, expectation Expectation, keys ...string) error {
+	if _, ok := ctx.Deadline(); !ok {
+		return errors.New("ExpectWithin requires a context with a deadline")
 	}
-	results := make(chan result)
+	return c.expectWithin(ctx, expectation, keys...)
+}
 
-	// producer wraps the expectation and allows the informer-driven flow to trigger
-	// it while the side effects of the call feed the channel we listen to here.
-	expectationCtx, expectationCancel := context.WithCancel(ctx)
-	defer expectationCancel()
-	producer := func() {
-		done, err := expectation(expectationCtx)
-		if expectationCtx.Err() == nil {
-			results <- result{
-				done: done,
-				err:  err,
+func (c *expectationController) expectWithin(ctx context.Context, expectation Expectation, keys ...string) (retErr error) {
+	id := uuid.New()
+	name := id.String()
+	logger := c.logger.WithValues("expectation", name)
+
+	// metricsLabel identifies this expectation to Prometheus. Unlike name, it
+	// must not be the per-call UUID: a new UUID every call would give every
+	// expectation its own ever-growing set of time series. The test name is
+	// shared by every expectation a given test registers, which is the
+	// granularity these metrics are meant to be profiled at.
+	metricsLabel := "unknown"
+	if c.t != nil {
+		metricsLabel = c.t.Name()
+	}
+
+	evalLog := &evaluationLog{}
+	if c.t != nil {
+		c.t.Cleanup(func() {
+			if retErr == nil {
+				return
+			}
+			for _, r := range evalLog.dump() {
+				c.t.Logf("expectation %s evaluation at %s (took %s): done=%v err=%v", name, r.time.Format(time.RFC3339Nano), r.elapsed, r.done, r.err)
 			}
+		})
+	}
+
+	var keySet map[string]struct{}
+	if len(keys) > 0 {
+		keySet = make(map[string]struct{}, len(keys))
+		for _, k := range keys {
+			keySet[k] = struct{}{}
 		}
 	}
 
-	id := uuid.New()
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), name)
+	reg := &registration{queue: queue, keys: keySet}
+
 	c.lock.Lock()
-	c.expectations[id] = producer
+	c.expectations[id] = reg
 	c.lock.Unlock()
-
 	defer func() {
 		c.lock.Lock()
 		delete(c.expectations, id)
 		c.lock.Unlock()
 	}()
 
-	// evaluate once to get the current state once we're registered to see future events
-	go producer()
+	expectationCtx, expectationCancel := context.WithCancel(ctx)
+	defer expectationCancel()
+
+	type result struct {
+		done bool
+		err  error
+	}
+	results := make(chan result, c.maxConcurrentReconciles)
+
+	var events int64
+
+	var workers sync.WaitGroup
+	workers.Add(c.maxConcurrentReconciles)
+	for i := 0; i < c.maxConcurrentReconciles; i++ {
+		go func() {
+			defer workers.Done()
+			for {
+				key, shutdown := queue.Get()
+				if shutdown {
+					return
+				}
+
+				start := time.Now()
+				done, err := expectation(expectationCtx)
+				elapsed := time.Since(start)
+				eventCount := atomic.AddInt64(&events, 1)
+				c.metrics.observe(metricsLabel, elapsed, err)
+				c.metrics.setQueueDepth(metricsLabel, queue.Len())
+				evalLog.record(evaluationRecord{time: start, elapsed: elapsed, done: done, err: err})
+				if err != nil {
+					logger.V(4).Error(err, "evaluated expectation", "elapsed", elapsed, "done", done, "events", eventCount)
+				} else {
+					logger.V(4).Info("evaluated expectation", "elapsed", elapsed, "done", done, "events", eventCount)
+				}
+
+				if expectationCtx.Err() != nil {
+					queue.Done(key)
+					continue
+				}
+				if err != nil {
+					queue.AddRateLimited(key)
+				} else {
+					queue.Forget(key)
+				}
+				queue.Done(key)
+
+				select {
+				case results <- result{done: done, err: err}:
+				case <-expectationCtx.Done():
+				}
+			}
+		}()
+	}
+
+	// evaluate once per key to get the current state once we're registered to see future events
+	if len(keys) == 0 {
+		queue.Add(triggerKey)
+	} else {
+		for _, k := range keys {
+			queue.Add(k)
+		}
+	}
+
+	finish := func() {
+		expectationCancel()
+		queue.ShutDown()
+		workers.Wait()
+	}
 
 	var expectationErrors []error
 	var processed int
 	for {
 		select {
 		case <-ctx.Done():
-			expectationCancel()
-			close(results)
-			return fmt.Errorf("expected state not found: %w, %d errors encountered while processing %d events: %v", ctx.Err(), len(expectationErrors), processed, kerrors.NewAggregate(expectationErrors))
+			finish()
+			retErr = fmt.Errorf("expected state not found: %w, %d errors encountered while processing %d events: %v", ctx.Err(), len(expectationErrors), processed, kerrors.NewAggregate(expectationErrors))
+			return retErr
 		case result := <-results:
 			processed += 1
 			if result.err != nil {
 				expectationErrors = append(expectationErrors, result.err)
 			}
 			if result.done {
+				finish()
 				if result.err == nil {
 					return nil
 				}
-				return kerrors.NewAggregate(expectationErrors)
+				retErr = kerrors.NewAggregate(expectationErrors)
+				return retErr
 			}
 		}
 	}
@@ -156,26 +400,18 @@ type RegisterWorkspaceExpectation func(seed *tenancyv1alpha1.Workspace, expectat
 type WorkspaceExpectation func(*tenancyv1alpha1.Workspace) error
 
 // ExpectWorkspaces sets up an Expecter in order to allow registering expectations in tests with minimal setup.
+// It shares a SharedInformerFactory with any other ExpectX helper constructed against the same client, rather
+// than starting a new one of its own.
 func ExpectWorkspaces(ctx context.Context, t TestingTInterface, client kcpclientset.Interface) (RegisterWorkspaceExpectation, error) {
-	kcpSharedInformerFactory := kcpexternalversions.NewSharedInformerFactoryWithOptions(client, 0)
-	workspaceInformer := kcpSharedInformerFactory.Tenancy().V1alpha1().Workspaces()
-	expecter := NewExpecter(workspaceInformer.Informer())
-	kcpSharedInformerFactory.Start(ctx.Done())
-	if !cache.WaitForNamedCacheSync(t.Name(), ctx.Done(), workspaceInformer.Informer().HasSynced) {
-		return nil, errors.New("failed to wait for caches to sync")
+	factory := sharedInformerFactoryFor(client)
+	workspaceInformer := factory.Tenancy().V1alpha1().Workspaces()
+	factory.Start(ctx.Done())
+	expecter, err := NewTypedExpecter[*tenancyv1alpha1.Workspace](ctx, t, workspaceInformer.Informer(), workspaceInformer.Lister())
+	if err != nil {
+		return nil, err
 	}
+	register := expecter.Expect(ctx, 30*time.Second)
 	return func(seed *tenancyv1alpha1.Workspace, expectation WorkspaceExpectation) error {
-		key, err := cache.MetaNamespaceKeyFunc(seed)
-		if err != nil {
-			return err
-		}
-		return expecter.ExpectBefore(ctx, func(ctx context.Context) (done bool, err error) {
-			current, err := workspaceInformer.Lister().Get(key)
-			if err != nil {
-				return !apierrors.IsNotFound(err), err
-			}
-			expectErr := expectation(current.DeepCopy())
-			return expectErr == nil, expectErr
-		}, 30*time.Second)
+		return register(seed, TypedExpectation[*tenancyv1alpha1.Workspace](expectation))
 	}, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// expecterMetrics records per-test queue depth, evaluation counts and latency
+// so that long e2e runs can be profiled and flaky expectations spotted. It's
+// a no-op collector (metrics are created but never registered) unless a
+// prometheus.Registerer is supplied to NewExpecter. Metrics are labeled by
+// test name rather than by expectation (each expectation gets a fresh UUID
+// per call, which would make for an ever-growing, effectively unbounded
+// label cardinality) - see expectWithin's metricsLabel.
+type expecterMetrics struct {
+	evaluationsTotal  *prometheus.CounterVec
+	errorsTotal       *prometheus.CounterVec
+	evaluationLatency *prometheus.HistogramVec
+	queueDepth        *prometheus.GaugeVec
+}
+
+func newExpecterMetrics(reg prometheus.Registerer) *expecterMetrics {
+	m := &expecterMetrics{
+		evaluationsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "kcp_e2e",
+			Subsystem: "expectation",
+			Name:      "evaluations_total",
+			Help:      "Total number of times an expectation's producer has been evaluated.",
+		}, []string{"test"}),
+		errorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "kcp_e2e",
+			Subsystem: "expectation",
+			Name:      "errors_total",
+			Help:      "Total number of expectation evaluations that returned an error.",
+		}, []string{"test"}),
+		evaluationLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "kcp_e2e",
+			Subsystem: "expectation",
+			Name:      "evaluation_duration_seconds",
+			Help:      "Latency of a single expectation evaluation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"test"}),
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "kcp_e2e",
+			Subsystem: "expectation",
+			Name:      "queue_depth",
+			Help:      "Current depth of an expectation's workqueue.",
+		}, []string{"test"}),
+	}
+
+	if reg == nil {
+		return m
+	}
+	m.evaluationsTotal = registerOrReuse(reg, m.evaluationsTotal)
+	m.errorsTotal = registerOrReuse(reg, m.errorsTotal)
+	m.evaluationLatency = registerOrReuse(reg, m.evaluationLatency)
+	m.queueDepth = registerOrReuse(reg, m.queueDepth)
+	return m
+}
+
+// registerOrReuse registers c with reg, returning c itself once registered.
+// If an equivalent collector is already registered - e.g. because a previous
+// NewExpecter call in the same test binary registered against the same
+// Registerer - it returns the already-registered collector instead, so
+// callers keep recording against the collector Prometheus is actually
+// exposing rather than an orphaned duplicate.
+func registerOrReuse[C prometheus.Collector](reg prometheus.Registerer, c C) C {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := are.ExistingCollector.(C); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return c
+}
+
+// observe records one expectation evaluation's outcome and latency, labeled
+// by the test that registered the expectation.
+func (m *expecterMetrics) observe(test string, elapsed time.Duration, err error) {
+	m.evaluationsTotal.WithLabelValues(test).Inc()
+	m.evaluationLatency.WithLabelValues(test).Observe(elapsed.Seconds())
+	if err != nil {
+		m.errorsTotal.WithLabelValues(test).Inc()
+	}
+}
+
+// setQueueDepth records the current depth of an expectation's workqueue,
+// labeled by the test that registered the expectation.
+func (m *expecterMetrics) setQueueDepth(test string, depth int) {
+	m.queueDepth.WithLabelValues(test).Set(float64(depth))
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	coordinationv1listers "k8s.io/client-go/listers/coordination/v1"
+)
+
+// RegisterLeaseExpectation registers an expectation that at least minHolders
+// distinct, non-expired leases matching the configured selector are observed
+// within timeout.
+type RegisterLeaseExpectation func(ctx context.Context, minHolders int, timeout time.Duration) error
+
+// ExpectShardLeases sets up an Expecter over coordination.k8s.io/v1 Leases
+// matching selector, modeled on the lease-counting readiness pattern used by
+// apiserver-network-proxy. It's meant for e2e assertions like "at least K
+// shards are healthy" or "the virtual-workspaces apiserver has re-acquired its
+// lease after a restart", without the caller having to hand-roll a polling
+// loop. It's wired through the same expectationController as ExpectWorkspaces,
+// so it composes with other registered expectations.
+func ExpectShardLeases(ctx context.Context, t TestingTInterface, client kubernetes.Interface, selector labels.Selector) (RegisterLeaseExpectation, error) {
+	leaseInformerFactory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+		opts.LabelSelector = selector.String()
+	}))
+	leaseInformer := leaseInformerFactory.Coordination().V1().Leases()
+	leaseInformerFactory.Start(ctx.Done())
+	expecter, err := NewExpecter(ctx, t, leaseInformer.Informer(), ExpecterOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	counter := NewCachedLeaseCounter(leaseInformer.Lister(), selector, 5*time.Second)
+
+	return func(ctx context.Context, minHolders int, timeout time.Duration) error {
+		return expecter.ExpectBefore(ctx, func(ctx context.Context) (done bool, err error) {
+			held, err := counter.Count()
+			if err != nil {
+				return false, err
+			}
+			if held < minHolders {
+				return false, fmt.Errorf("observed %d healthy leases, want at least %d", held, minHolders)
+			}
+			return true, nil
+		}, timeout)
+	}, nil
+}
+
+// CachedLeaseCounter memoizes the count of non-expired leases matching a
+// selector for a TTL, so that a trigger fired on every informer event doesn't
+// re-list and re-evaluate lease expiry each time.
+type CachedLeaseCounter struct {
+	lister   coordinationv1listers.LeaseLister
+	selector labels.Selector
+	ttl      time.Duration
+
+	lock     sync.Mutex
+	computed time.Time
+	count    int
+	countErr error
+}
+
+// NewCachedLeaseCounter returns a CachedLeaseCounter that counts leases from
+// lister matching selector, caching the result for ttl.
+func NewCachedLeaseCounter(lister coordinationv1listers.LeaseLister, selector labels.Selector, ttl time.Duration) *CachedLeaseCounter {
+	return &CachedLeaseCounter{
+		lister:   lister,
+		selector: selector,
+		ttl:      ttl,
+	}
+}
+
+// Count returns the number of currently-held (non-expired) leases, recomputing
+// from the lister only once the cached value is older than the configured TTL.
+func (c *CachedLeaseCounter) Count() (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if time.Since(c.computed) < c.ttl {
+		return c.count, c.countErr
+	}
+
+	leases, err := c.lister.List(c.selector)
+	c.computed = time.Now()
+	if err != nil {
+		c.count, c.countErr = 0, err
+		return c.count, c.countErr
+	}
+
+	var held int
+	now := time.Now()
+	for _, lease := range leases {
+		if leaseIsHeld(lease, now) {
+			held++
+		}
+	}
+	c.count, c.countErr = held, nil
+	return c.count, c.countErr
+}
+
+// leaseIsHeld reports whether lease was renewed recently enough that it
+// hasn't yet expired as of now.
+func leaseIsHeld(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return now.Before(expiry)
+}
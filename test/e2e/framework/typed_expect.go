@@ -0,0 +1,223 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package framework
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	conditionsv1alpha1 "github.com/kcp-dev/apimachinery/pkg/apis/conditions/v1alpha1"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/events"
+
+	kcpclientset "github.com/kcp-dev/kcp/pkg/client/clientset/versioned"
+	kcpexternalversions "github.com/kcp-dev/kcp/pkg/client/informers/externalversions"
+)
+
+// TypedLister is satisfied by the per-type Lister generated for any KCP (or
+// Kubernetes) API object, e.g. tenancyv1alpha1listers.WorkspaceLister.
+type TypedLister[T runtime.Object] interface {
+	Get(name string) (T, error)
+}
+
+// TypedExpectation evaluates an expectation about the current state of T.
+type TypedExpectation[T runtime.Object] func(T) error
+
+// RegisterExpectation registers an expectation about the future state of the
+// seed, keyed by the seed's namespace/name.
+type RegisterExpectation[T runtime.Object] func(seed T, expectation TypedExpectation[T]) error
+
+// TypedExpecter drives expectations about objects of type T on top of a single
+// Expecter and Lister pair. Construct one with NewTypedExpecter for any
+// informer/lister combination - Workspaces, ClusterWorkspaces, APIExports,
+// APIBindings, WorkloadClusters, etc all satisfy the same shape.
+type TypedExpecter[T runtime.Object] struct {
+	expecter Expecter
+	lister   TypedLister[T]
+	recorder events.EventRecorder
+
+	lock  sync.Mutex
+	calls map[string]*typedExpectationCall
+}
+
+// typedExpectationCall lets concurrent RegisterExpectation calls for the same
+// key share a single in-flight producer instead of each starting their own.
+type typedExpectationCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+// NewTypedExpecter creates an Expecter for objects of type T over the given
+// informer/lister pair, waiting for the informer's cache to sync before
+// returning.
+func NewTypedExpecter[T runtime.Object](ctx context.Context, t TestingTInterface, informer cache.SharedIndexInformer, lister TypedLister[T]) (*TypedExpecter[T], error) {
+	expecter, err := NewExpecter(ctx, t, informer, ExpecterOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return &TypedExpecter[T]{
+		expecter: expecter,
+		lister:   lister,
+		calls:    map[string]*typedExpectationCall{},
+	}, nil
+}
+
+// WithEventRecorder configures e to emit a Kubernetes Event on the seed object
+// whenever a registered expectation finally succeeds or times out.
+func (e *TypedExpecter[T]) WithEventRecorder(recorder events.EventRecorder) *TypedExpecter[T] {
+	e.recorder = recorder
+	return e
+}
+
+// Expect returns a RegisterExpectation bound to this TypedExpecter, evaluating
+// registered expectations up until the given timeout. Concurrent registrations
+// for the same key are deduplicated: only the first caller's producer runs,
+// and every caller for that key observes its result.
+func (e *TypedExpecter[T]) Expect(ctx context.Context, timeout time.Duration) RegisterExpectation[T] {
+	return func(seed T, expectation TypedExpectation[T]) error {
+		return e.expect(ctx, timeout, seed, func(current T, getErr error) (bool, error) {
+			if getErr != nil {
+				return !apierrors.IsNotFound(getErr), getErr
+			}
+			expectErr := expectation(current)
+			return expectErr == nil, expectErr
+		})
+	}
+}
+
+// ExpectDeletion blocks until the seed is no longer present according to the
+// Lister, or ctx is done / timeout elapses.
+func (e *TypedExpecter[T]) ExpectDeletion(ctx context.Context, seed T, timeout time.Duration) error {
+	return e.expect(ctx, timeout, seed, func(current T, getErr error) (bool, error) {
+		if apierrors.IsNotFound(getErr) {
+			return true, nil
+		}
+		if getErr != nil {
+			return false, getErr
+		}
+		return false, fmt.Errorf("object still exists")
+	})
+}
+
+// expect drives produce (a seed's current state from the Lister, or the
+// error from getting it) against e.expecter until produce reports done or
+// ctx/timeout expires, deduplicating concurrent calls for the same key and
+// recording an event on the seed if a recorder is configured.
+func (e *TypedExpecter[T]) expect(ctx context.Context, timeout time.Duration, seed T, produce func(current T, getErr error) (bool, error)) error {
+	key, err := cache.MetaNamespaceKeyFunc(seed)
+	if err != nil {
+		return err
+	}
+
+	e.lock.Lock()
+	if call, ok := e.calls[key]; ok {
+		e.lock.Unlock()
+		call.wg.Wait()
+		return call.err
+	}
+	call := &typedExpectationCall{}
+	call.wg.Add(1)
+	e.calls[key] = call
+	e.lock.Unlock()
+
+	call.err = e.expecter.ExpectBefore(ctx, func(ctx context.Context) (bool, error) {
+		current, err := e.lister.Get(key)
+		return produce(current, err)
+	}, timeout, key)
+
+	if e.recorder != nil {
+		if call.err == nil {
+			e.recorder.Eventf(seed, nil, corev1.EventTypeNormal, "ExpectationMet", "Evaluate", "expectation was satisfied")
+		} else {
+			e.recorder.Eventf(seed, nil, corev1.EventTypeWarning, "ExpectationTimeout", "Evaluate", "expectation timed out: %v", call.err)
+		}
+	}
+
+	e.lock.Lock()
+	delete(e.calls, key)
+	e.lock.Unlock()
+	call.wg.Done()
+
+	return call.err
+}
+
+// ExpectCondition returns a TypedExpectation that is satisfied once the object
+// reports the given condition type with the given status.
+func ExpectCondition[T interface {
+	runtime.Object
+	GetConditions() conditionsv1alpha1.Conditions
+}](conditionType conditionsv1alpha1.ConditionType, status corev1.ConditionStatus) TypedExpectation[T] {
+	return func(obj T) error {
+		for _, c := range obj.GetConditions() {
+			if c.Type != conditionType {
+				continue
+			}
+			if c.Status == status {
+				return nil
+			}
+			return fmt.Errorf("condition %s is %s, want %s: %s", conditionType, c.Status, status, c.Message)
+		}
+		return fmt.Errorf("condition %s not found", conditionType)
+	}
+}
+
+// ExpectPhase returns a TypedExpectation that is satisfied once phaseOf(obj)
+// reports the desired phase. The caller supplies the accessor since the
+// generated phase types differ per resource (tenancyv1alpha1.WorkspacePhaseType,
+// ClusterWorkspacePhaseType, etc) but all compare equal as strings.
+func ExpectPhase[T runtime.Object](phaseOf func(T) string, desired string) TypedExpectation[T] {
+	return func(obj T) error {
+		if actual := phaseOf(obj); actual != desired {
+			return fmt.Errorf("expected phase %q, got %q", desired, actual)
+		}
+		return nil
+	}
+}
+
+// sharedInformerFactories caches one SharedInformerFactory per client so that
+// many ExpectX helpers against the same cluster connection share a single set
+// of watches instead of each opening their own, as ExpectWorkspaces used to.
+var (
+	sharedInformerFactoriesLock sync.Mutex
+	sharedInformerFactories     = map[kcpclientset.Interface]kcpexternalversions.SharedInformerFactory{}
+)
+
+// sharedInformerFactoryFor returns the process-wide SharedInformerFactory for
+// client, creating it on first use. It deliberately does not call Start:
+// SharedInformerFactory.Start only starts informers already registered in its
+// internal map, so starting it here - before any caller has asked for a
+// specific informer via e.g. .Workspaces() - would be a no-op. Callers must
+// obtain their informer(s) and then call factory.Start(ctx.Done()) themselves,
+// same as the baseline ExpectWorkspaces did; Start is safe to call repeatedly
+// and only starts informers that aren't already running.
+func sharedInformerFactoryFor(client kcpclientset.Interface) kcpexternalversions.SharedInformerFactory {
+	sharedInformerFactoriesLock.Lock()
+	defer sharedInformerFactoriesLock.Unlock()
+
+	factory, ok := sharedInformerFactories[client]
+	if !ok {
+		factory = kcpexternalversions.NewSharedInformerFactoryWithOptions(client, 0)
+		sharedInformerFactories[client] = factory
+	}
+	return factory
+}